@@ -18,30 +18,128 @@
 package channel
 
 import (
+	"context"
 	"errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/polevpn/netstack/tcpip"
 	"github.com/polevpn/netstack/tcpip/buffer"
 	"github.com/polevpn/netstack/tcpip/stack"
 )
 
+// ErrEndpointClosed is returned by WritePacketCtx when the endpoint has
+// already been closed.
+var ErrEndpointClosed = errors.New("channel: endpoint closed")
+
+// ErrLinkDown is returned by WritePacketCtx when the endpoint's link is
+// down. WritePacket, WritePackets, and WriteRawPacket report the same
+// condition as tcpip.ErrNoLinkAddress, since they are constrained to the
+// *tcpip.Error return type used throughout stack.LinkEndpoint.
+var ErrLinkDown = errors.New("channel: link is down")
+
+// LinkStateDispatcher is implemented by types that want to be notified when
+// the endpoint's link comes up or goes down, e.g. the stack registering
+// itself via AttachLinkState.
+type LinkStateDispatcher interface {
+	NotifyLinkStateChange(up bool)
+}
+
+// WritePolicy controls how WritePacket, WritePackets, and WriteRawPacket
+// behave when the outbound channel is full.
+type WritePolicy int
+
+const (
+	// PolicyDrop silently drops the packet when the channel is full. This
+	// is the default and matches the endpoint's original behavior.
+	PolicyDrop WritePolicy = iota
+	// PolicyBlock blocks the writer until the channel has room.
+	PolicyBlock
+	// PolicyBlockWithContext behaves like PolicyBlock, but callers using
+	// WritePacketCtx are unblocked with an error if their context is done
+	// before the packet can be queued.
+	PolicyBlockWithContext
+)
+
+// Stats holds counters describing the outbound channel's queueing behavior.
+type Stats struct {
+	// PacketsDropped counts packets discarded because the channel was
+	// full under PolicyDrop.
+	PacketsDropped uint64
+	// PacketsQueued counts packets successfully enqueued.
+	PacketsQueued uint64
+	// BytesQueued counts the payload bytes of successfully enqueued
+	// packets.
+	BytesQueued uint64
+	// LinkDownDrops counts inbound packets dropped by InjectInbound and
+	// InjectLinkAddr because the link was down.
+	LinkDownDrops uint64
+}
+
+// Packet type classifications for PacketInfo.PktType, mirroring the
+// PACKET_HOST family of constants Linux reports on AF_PACKET sockets.
+const (
+	// PacketHost indicates the packet's destination link address is this
+	// endpoint's own address.
+	PacketHost = iota
+	// PacketBroadcast indicates the packet was sent to the link-layer
+	// broadcast address.
+	PacketBroadcast
+	// PacketMulticast indicates the packet was sent to a multicast
+	// link-layer address.
+	PacketMulticast
+	// PacketOtherHost indicates the packet's destination link address
+	// belongs to neither this endpoint nor a broadcast/multicast group.
+	PacketOtherHost
+	// PacketOutgoing indicates the packet originated locally and is being
+	// transmitted, as opposed to having been received off the wire.
+	PacketOutgoing
+)
+
 // PacketInfo holds all the information about an outbound packet.
 type PacketInfo struct {
-	Pkt   tcpip.PacketBuffer
-	Proto tcpip.NetworkProtocolNumber
-	GSO   *stack.GSO
+	Pkt     tcpip.PacketBuffer
+	Proto   tcpip.NetworkProtocolNumber
+	GSO     *stack.GSO
+	PktType byte
+}
+
+// OutboundPacketDispatcher is implemented by types that want to observe
+// outbound packets as they are written to the endpoint, before they are
+// queued. It mirrors stack.NetworkDispatcher's addressing arguments so the
+// same shape can back an AF_PACKET-style capture socket built on top of this
+// package.
+type OutboundPacketDispatcher interface {
+	DeliverOutboundPacket(remote, local tcpip.LinkAddress, proto tcpip.NetworkProtocolNumber, pkt tcpip.PacketBuffer)
 }
 
 // Endpoint is link layer endpoint that stores outbound packets in a channel
 // and allows injection of inbound packets.
 type Endpoint struct {
 	dispatcher stack.NetworkDispatcher
+	outbound   OutboundPacketDispatcher
 	mtu        uint32
 	linkAddr   tcpip.LinkAddress
 	GSO        bool
-	closed     bool
-	mu         *sync.RWMutex
+	// Promiscuous, when set, causes InjectLinkAddr to dispatch inbound
+	// packets regardless of their destination link address.
+	Promiscuous bool
+	// SoftwareSegment, when set, causes WritePacket and WritePackets to
+	// segment outbound GSO packets into MTU-sized fragments themselves
+	// rather than handing an oversized packet to the reader.
+	SoftwareSegment bool
+	closed          bool
+	linkUp          bool
+	linkState       LinkStateDispatcher
+	mu              *sync.RWMutex
+	// policy controls how outbound writes behave when ch is full.
+	policy WritePolicy
+	// writeMu serializes the enqueueing of outbound packets so that a
+	// blocking write from one caller cannot be interleaved with packets
+	// from a concurrent caller.
+	writeMu sync.Mutex
+	stats   Stats
 	// C is where outbound packets are queued.
 	ch chan PacketInfo
 }
@@ -53,10 +151,209 @@ func New(size int, mtu uint32, linkAddr tcpip.LinkAddress) *Endpoint {
 		mtu:      mtu,
 		linkAddr: linkAddr,
 		closed:   false,
+		linkUp:   true,
 		mu:       &sync.RWMutex{},
 	}
 }
 
+// AttachLinkState registers handler to be notified whenever SetLinkUp
+// changes the endpoint's link state.
+func (e *Endpoint) AttachLinkState(handler LinkStateDispatcher) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.linkState = handler
+}
+
+// SetLinkAddress changes the endpoint's link address.
+func (e *Endpoint) SetLinkAddress(addr tcpip.LinkAddress) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.linkAddr = addr
+}
+
+// SetMTU changes the endpoint's MTU.
+func (e *Endpoint) SetMTU(mtu uint32) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.mtu = mtu
+}
+
+// SetLinkUp changes the endpoint's link state. If the state actually
+// changes, the handler registered via AttachLinkState, if any, is notified.
+// While the link is down, WritePacket, WritePackets, WriteRawPacket, and
+// WritePacketCtx fail with ErrLinkDown (or tcpip.ErrNoLinkAddress), and
+// InjectInbound and InjectLinkAddr drop incoming packets.
+func (e *Endpoint) SetLinkUp(up bool) {
+	e.mu.Lock()
+	changed := e.linkUp != up
+	e.linkUp = up
+	handler := e.linkState
+	e.mu.Unlock()
+
+	if changed && handler != nil {
+		handler.NotifyLinkStateChange(up)
+	}
+}
+
+// IsLinkUp reports whether the endpoint's link is currently up.
+func (e *Endpoint) IsLinkUp() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.linkUp
+}
+
+// SetWritePolicy changes how outbound writes behave when the channel is
+// full. It may be called at any time, including after the endpoint has
+// started carrying traffic.
+func (e *Endpoint) SetWritePolicy(policy WritePolicy) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.policy = policy
+}
+
+// GetStats returns a snapshot of the endpoint's outbound queueing counters.
+func (e *Endpoint) GetStats() Stats {
+	return Stats{
+		PacketsDropped: atomic.LoadUint64(&e.stats.PacketsDropped),
+		PacketsQueued:  atomic.LoadUint64(&e.stats.PacketsQueued),
+		BytesQueued:    atomic.LoadUint64(&e.stats.BytesQueued),
+		LinkDownDrops:  atomic.LoadUint64(&e.stats.LinkDownDrops),
+	}
+}
+
+// enqueueSegments queues segs, in order, according to policy. It must be
+// called without holding e.mu: PolicyBlock and PolicyBlockWithContext can
+// block indefinitely, and holding e.mu across that block would prevent
+// concurrent state changes (Close, SetLinkUp, SetMTU, SetLinkAddress,
+// SetWritePolicy, AttachLinkState) from ever acquiring the write lock.
+//
+// Under PolicyDrop, room for every segment is reserved up front so a
+// multi-segment packet (see Segment) is never partially queued: a caller
+// that reinterprets the returned count as "how many hdrs were consumed"
+// must never see some, but not all, of a single hdr's segments land on the
+// channel while that hdr is reported as not consumed and thus retried.
+//
+// It reports the number of segments actually queued. Because e.ch may be
+// closed concurrently by Close once this call no longer holds e.mu, a send
+// on the now-closed channel is recovered and reported as ErrEndpointClosed
+// rather than panicking the caller's goroutine.
+func (e *Endpoint) enqueueSegments(ctx context.Context, policy WritePolicy, segs []PacketInfo) (queued int, err error) {
+	e.writeMu.Lock()
+	defer e.writeMu.Unlock()
+
+	defer func() {
+		if recover() != nil {
+			err = ErrEndpointClosed
+		}
+	}()
+
+	if policy == PolicyDrop && len(segs) > cap(e.ch)-len(e.ch) {
+		atomic.AddUint64(&e.stats.PacketsDropped, uint64(len(segs)))
+		return 0, nil
+	}
+
+	for _, p := range segs {
+		switch policy {
+		case PolicyBlock:
+			e.ch <- p
+		case PolicyBlockWithContext:
+			select {
+			case e.ch <- p:
+			case <-ctx.Done():
+				return queued, ctx.Err()
+			}
+		default: // PolicyDrop; room was already reserved above.
+			e.ch <- p
+		}
+
+		atomic.AddUint64(&e.stats.PacketsQueued, 1)
+		atomic.AddUint64(&e.stats.BytesQueued, uint64(p.Pkt.Header.UsedLength()+p.Pkt.Data.Size()))
+		queued++
+	}
+	return queued, nil
+}
+
+// maybeSegment returns pkt split into MTU-sized fragments when segment is
+// true and gso describes a segmentable packet; otherwise it returns pkt
+// unchanged. split reports whether fragmentation actually happened, so
+// callers can tell a freshly-split, already-MTU-sized fragment apart from a
+// single packet that may still need segmentation downstream.
+func maybeSegment(pkt tcpip.PacketBuffer, gso *stack.GSO, segment bool, mtu uint32) (segs []tcpip.PacketBuffer, split bool) {
+	if !segment || gso == nil {
+		return []tcpip.PacketBuffer{pkt}, false
+	}
+	segs = Segment(pkt, gso, mtu)
+	return segs, len(segs) > 1
+}
+
+// packetInfos builds a PacketInfo per pkt, sharing proto and pktType across
+// all of them. gso is attached to each PacketInfo only when split is false:
+// once a packet has actually been fragmented, every resulting fragment is
+// already MTU-sized, and reporting the original (pre-split) GSO descriptor
+// on it would tell a TSO-aware reader to segment it again.
+func packetInfos(pkts []tcpip.PacketBuffer, split bool, proto tcpip.NetworkProtocolNumber, gso *stack.GSO, pktType byte) []PacketInfo {
+	if split {
+		gso = nil
+	}
+	infos := make([]PacketInfo, len(pkts))
+	for i, pkt := range pkts {
+		infos[i] = PacketInfo{Pkt: pkt, Proto: proto, GSO: gso, PktType: pktType}
+	}
+	return infos
+}
+
+// AttachOutbound registers handler to be notified of every outbound packet
+// written through WritePacket, WritePackets, and WriteRawPacket, before it is
+// queued on the channel.
+func (e *Endpoint) AttachOutbound(handler OutboundPacketDispatcher) {
+	e.outbound = handler
+}
+
+// classifyPacketType computes the PacketInfo.PktType for a packet destined
+// to dst on an endpoint whose own address is own. outgoing is true for
+// packets this endpoint is transmitting, which Linux always reports as
+// PacketOutgoing regardless of the destination address.
+func classifyPacketType(dst, own tcpip.LinkAddress, outgoing bool) byte {
+	if outgoing {
+		return PacketOutgoing
+	}
+	switch {
+	case dst == own:
+		return PacketHost
+	case isBroadcastLinkAddr(dst):
+		return PacketBroadcast
+	case isMulticastLinkAddr(dst):
+		return PacketMulticast
+	default:
+		return PacketOtherHost
+	}
+}
+
+// isBroadcastLinkAddr reports whether addr is the all-ones link-layer
+// broadcast address.
+func isBroadcastLinkAddr(addr tcpip.LinkAddress) bool {
+	if len(addr) == 0 {
+		return false
+	}
+	for i := 0; i < len(addr); i++ {
+		if addr[i] != 0xff {
+			return false
+		}
+	}
+	return true
+}
+
+// isMulticastLinkAddr reports whether addr has the multicast bit set, as
+// found in the low-order bit of the first byte of a MAC-48 address.
+func isMulticastLinkAddr(addr tcpip.LinkAddress) bool {
+	return len(addr) != 0 && addr[0]&0x01 != 0
+}
+
 // Drain removes all outbound packets from the channel and counts them.
 func (e *Endpoint) Drain() int {
 
@@ -81,6 +378,80 @@ func (e *Endpoint) Read() (*PacketInfo, error) {
 
 }
 
+// ReadContext behaves like Read, but returns ctx.Err() if ctx is done
+// before a packet arrives.
+func (e *Endpoint) ReadContext(ctx context.Context) (*PacketInfo, error) {
+	select {
+	case pkgInfo, ok := <-e.ch:
+		if !ok {
+			return nil, errors.New("link channel closed")
+		}
+		return &pkgInfo, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NumQueued returns the number of outbound packets currently buffered in
+// the channel, so callers can size ReadBatch calls adaptively.
+func (e *Endpoint) NumQueued() int {
+	return len(e.ch)
+}
+
+// ReadBatch drains up to len(dst) queued outbound packets into dst in a
+// single call, returning the number read. If no packet is queued, it waits
+// up to minWait for the first one to arrive; once at least one packet has
+// been read, it greedily drains whatever else is immediately available
+// without blocking further.
+func (e *Endpoint) ReadBatch(dst []PacketInfo, minWait time.Duration) (int, error) {
+	if len(dst) == 0 {
+		return 0, nil
+	}
+
+	if minWait <= 0 {
+		// No wait requested: poll once instead of falling through to the
+		// select below, where a nil timeout channel would never fire and
+		// this would block exactly like Read.
+		select {
+		case pkgInfo, ok := <-e.ch:
+			if !ok {
+				return 0, errors.New("link channel closed")
+			}
+			dst[0] = pkgInfo
+		default:
+			return 0, nil
+		}
+	} else {
+		timer := time.NewTimer(minWait)
+		defer timer.Stop()
+
+		select {
+		case pkgInfo, ok := <-e.ch:
+			if !ok {
+				return 0, errors.New("link channel closed")
+			}
+			dst[0] = pkgInfo
+		case <-timer.C:
+			return 0, nil
+		}
+	}
+
+	n := 1
+	for n < len(dst) {
+		select {
+		case pkgInfo, ok := <-e.ch:
+			if !ok {
+				return n, nil
+			}
+			dst[n] = pkgInfo
+			n++
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
 func (e *Endpoint) Close() {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -97,7 +468,9 @@ func (e *Endpoint) InjectInbound(protocol tcpip.NetworkProtocolNumber, pkt tcpip
 	e.InjectLinkAddr(protocol, "", pkt)
 }
 
-// InjectLinkAddr injects an inbound packet with a remote link address.
+// InjectLinkAddr injects an inbound packet with a remote link address. If
+// remote is a unicast address other than this endpoint's own and the
+// endpoint is not Promiscuous, the packet is dropped rather than dispatched.
 func (e *Endpoint) InjectLinkAddr(protocol tcpip.NetworkProtocolNumber, remote tcpip.LinkAddress, pkt tcpip.PacketBuffer) {
 
 	e.mu.RLock()
@@ -107,6 +480,15 @@ func (e *Endpoint) InjectLinkAddr(protocol tcpip.NetworkProtocolNumber, remote t
 		return
 	}
 
+	if !e.linkUp {
+		atomic.AddUint64(&e.stats.LinkDownDrops, 1)
+		return
+	}
+
+	if !e.Promiscuous && remote != "" && classifyPacketType(remote, e.linkAddr, false) == PacketOtherHost {
+		return
+	}
+
 	e.dispatcher.DeliverNetworkPacket(e, remote, "" /* local */, protocol, pkt)
 }
 
@@ -124,6 +506,9 @@ func (e *Endpoint) IsAttached() bool {
 // MTU implements stack.LinkEndpoint.MTU. It returns the value initialized
 // during construction.
 func (e *Endpoint) MTU() uint32 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	return e.mtu
 }
 
@@ -133,6 +518,9 @@ func (e *Endpoint) Capabilities() stack.LinkEndpointCapabilities {
 	if e.GSO {
 		caps |= stack.CapabilityHardwareGSO
 	}
+	if e.SoftwareSegment {
+		caps |= CapabilitySoftwareGSO
+	}
 	return caps
 }
 
@@ -149,64 +537,113 @@ func (*Endpoint) MaxHeaderLength() uint16 {
 
 // LinkAddress returns the link address of this endpoint.
 func (e *Endpoint) LinkAddress() tcpip.LinkAddress {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	return e.linkAddr
 }
 
 // WritePacket stores outbound packets into the channel.
-func (e *Endpoint) WritePacket(_ *stack.Route, gso *stack.GSO, protocol tcpip.NetworkProtocolNumber, pkt tcpip.PacketBuffer) *tcpip.Error {
+func (e *Endpoint) WritePacket(route *stack.Route, gso *stack.GSO, protocol tcpip.NetworkProtocolNumber, pkt tcpip.PacketBuffer) *tcpip.Error {
 
 	e.mu.RLock()
-	defer e.mu.RUnlock()
-
 	if e.closed {
+		e.mu.RUnlock()
 		return tcpip.ErrBadLinkEndpoint
 	}
-
-	p := PacketInfo{
-		Pkt:   pkt,
-		Proto: protocol,
-		GSO:   gso,
+	if !e.linkUp {
+		e.mu.RUnlock()
+		return tcpip.ErrNoLinkAddress
 	}
+	policy, linkAddr, outbound, segment, mtu := e.policy, e.linkAddr, e.outbound, e.SoftwareSegment, e.mtu
+	e.mu.RUnlock()
 
-	select {
-	case e.ch <- p:
-	default:
+	remote := route.RemoteLinkAddress
+	if outbound != nil {
+		outbound.DeliverOutboundPacket(remote, linkAddr, protocol, pkt)
 	}
 
+	pktType := classifyPacketType(remote, linkAddr, true /* outgoing */)
+	frags, split := maybeSegment(pkt, gso, segment, mtu)
+	segs := packetInfos(frags, split, protocol, gso, pktType)
+	e.enqueueSegments(context.Background(), policy, segs)
+
 	return nil
 }
 
-// WritePackets stores outbound packets into the channel.
-func (e *Endpoint) WritePackets(_ *stack.Route, gso *stack.GSO, hdrs []stack.PacketDescriptor, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) (int, *tcpip.Error) {
+// WritePacketCtx behaves like WritePacket, except that under
+// PolicyBlockWithContext it returns ctx.Err() if ctx is done before the
+// packet can be queued.
+func (e *Endpoint) WritePacketCtx(ctx context.Context, route *stack.Route, gso *stack.GSO, protocol tcpip.NetworkProtocolNumber, pkt tcpip.PacketBuffer) error {
 
 	e.mu.RLock()
-	defer e.mu.RUnlock()
+	if e.closed {
+		e.mu.RUnlock()
+		return ErrEndpointClosed
+	}
+	if !e.linkUp {
+		e.mu.RUnlock()
+		return ErrLinkDown
+	}
+	policy, linkAddr, outbound, segment, mtu := e.policy, e.linkAddr, e.outbound, e.SoftwareSegment, e.mtu
+	e.mu.RUnlock()
+
+	remote := route.RemoteLinkAddress
+	if outbound != nil {
+		outbound.DeliverOutboundPacket(remote, linkAddr, protocol, pkt)
+	}
+
+	pktType := classifyPacketType(remote, linkAddr, true /* outgoing */)
+	frags, split := maybeSegment(pkt, gso, segment, mtu)
+	segs := packetInfos(frags, split, protocol, gso, pktType)
+	_, err := e.enqueueSegments(ctx, policy, segs)
+	return err
+}
 
+// WritePackets stores outbound packets into the channel.
+func (e *Endpoint) WritePackets(route *stack.Route, gso *stack.GSO, hdrs []stack.PacketDescriptor, payload buffer.VectorisedView, protocol tcpip.NetworkProtocolNumber) (int, *tcpip.Error) {
+
+	e.mu.RLock()
 	if e.closed {
+		e.mu.RUnlock()
 		return 0, tcpip.ErrBadLinkEndpoint
 	}
+	if !e.linkUp {
+		e.mu.RUnlock()
+		return 0, tcpip.ErrNoLinkAddress
+	}
+	policy, linkAddr, outbound, segment, mtu := e.policy, e.linkAddr, e.outbound, e.SoftwareSegment, e.mtu
+	e.mu.RUnlock()
 
+	remote := route.RemoteLinkAddress
 	payloadView := payload.ToView()
 	n := 0
-packetLoop:
 	for _, hdr := range hdrs {
 		off := hdr.Off
 		size := hdr.Size
-		p := PacketInfo{
-			Pkt: tcpip.PacketBuffer{
-				Header: hdr.Hdr,
-				Data:   buffer.NewViewFromBytes(payloadView[off : off+size]).ToVectorisedView(),
-			},
-			Proto: protocol,
-			GSO:   gso,
+		pkt := tcpip.PacketBuffer{
+			Header: hdr.Hdr,
+			Data:   buffer.NewViewFromBytes(payloadView[off : off+size]).ToVectorisedView(),
 		}
 
-		select {
-		case e.ch <- p:
-			n++
-		default:
-			break packetLoop
+		if outbound != nil {
+			outbound.DeliverOutboundPacket(remote, linkAddr, protocol, pkt)
+		}
+
+		pktType := classifyPacketType(remote, linkAddr, true /* outgoing */)
+		frags, split := maybeSegment(pkt, gso, segment, mtu)
+		segs := packetInfos(frags, split, protocol, gso, pktType)
+
+		// enqueueSegments either queues every segment of hdr or none of
+		// them (see its doc comment), so a hdr is only ever counted in n
+		// once all of its segments are safely on the channel — a caller
+		// retrying hdrs[n:] can never re-segment and re-send bytes that
+		// are already queued.
+		queued, _ := e.enqueueSegments(context.Background(), policy, segs)
+		if queued < len(segs) {
+			break
 		}
+		n++
 	}
 
 	return n, nil
@@ -216,22 +653,31 @@ packetLoop:
 func (e *Endpoint) WriteRawPacket(vv buffer.VectorisedView) *tcpip.Error {
 
 	e.mu.RLock()
-	defer e.mu.RUnlock()
-
 	if e.closed {
+		e.mu.RUnlock()
 		return tcpip.ErrBadLinkEndpoint
 	}
-	p := PacketInfo{
-		Pkt:   tcpip.PacketBuffer{Data: vv},
-		Proto: 0,
-		GSO:   nil,
+	if !e.linkUp {
+		e.mu.RUnlock()
+		return tcpip.ErrNoLinkAddress
 	}
+	policy, linkAddr, outbound := e.policy, e.linkAddr, e.outbound
+	e.mu.RUnlock()
 
-	select {
-	case e.ch <- p:
-	default:
+	pkt := tcpip.PacketBuffer{Data: vv}
+	if outbound != nil {
+		outbound.DeliverOutboundPacket("" /* remote */, linkAddr, 0, pkt)
 	}
 
+	p := PacketInfo{
+		Pkt:     pkt,
+		Proto:   0,
+		GSO:     nil,
+		PktType: PacketOutgoing,
+	}
+
+	e.enqueueSegments(context.Background(), policy, []PacketInfo{p})
+
 	return nil
 }
 
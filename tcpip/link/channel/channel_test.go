@@ -0,0 +1,377 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package channel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/polevpn/netstack/tcpip"
+	"github.com/polevpn/netstack/tcpip/buffer"
+	"github.com/polevpn/netstack/tcpip/header"
+	"github.com/polevpn/netstack/tcpip/stack"
+)
+
+// emptyRoute is a zero-value route whose RemoteLinkAddress is "", used by
+// tests that don't care about per-destination classification.
+var emptyRoute stack.Route
+
+func TestClassifyPacketType(t *testing.T) {
+	const own tcpip.LinkAddress = "\x00\x11\x22\x33\x44\x55"
+	const other tcpip.LinkAddress = "\x00\x11\x22\x33\x44\x66"
+
+	tests := []struct {
+		name     string
+		dst      tcpip.LinkAddress
+		outgoing bool
+		want     byte
+	}{
+		{"outgoing always PacketOutgoing", other, true, PacketOutgoing},
+		{"own address is PacketHost", own, false, PacketHost},
+		{"all-ones is PacketBroadcast", "\xff\xff\xff\xff\xff\xff", false, PacketBroadcast},
+		{"multicast bit set is PacketMulticast", "\x01\x00\x5e\x00\x00\x01", false, PacketMulticast},
+		{"anything else is PacketOtherHost", other, false, PacketOtherHost},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := classifyPacketType(test.dst, own, test.outgoing); got != test.want {
+				t.Errorf("classifyPacketType(%q, %q, %v) = %d, want %d", test.dst, own, test.outgoing, got, test.want)
+			}
+		})
+	}
+}
+
+// fakeOutboundDispatcher records every packet delivered to it via
+// DeliverOutboundPacket.
+type fakeOutboundDispatcher struct {
+	remote, local tcpip.LinkAddress
+	proto         tcpip.NetworkProtocolNumber
+	calls         int
+}
+
+func (f *fakeOutboundDispatcher) DeliverOutboundPacket(remote, local tcpip.LinkAddress, proto tcpip.NetworkProtocolNumber, pkt tcpip.PacketBuffer) {
+	f.remote, f.local, f.proto = remote, local, proto
+	f.calls++
+}
+
+func TestWritePacketDeliversToOutboundDispatcher(t *testing.T) {
+	const linkAddr tcpip.LinkAddress = "\x00\x11\x22\x33\x44\x55"
+	e := New(1, 1500, linkAddr)
+
+	var dispatcher fakeOutboundDispatcher
+	e.AttachOutbound(&dispatcher)
+
+	pkt := buildTCPv4(t, []byte("hello"))
+	if err := e.WritePacket(&emptyRoute, nil, 0, pkt); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+
+	if dispatcher.calls != 1 {
+		t.Fatalf("DeliverOutboundPacket called %d times, want 1", dispatcher.calls)
+	}
+	if dispatcher.local != linkAddr {
+		t.Errorf("DeliverOutboundPacket local = %q, want %q", dispatcher.local, linkAddr)
+	}
+
+	if _, err := e.Read(); err != nil {
+		t.Errorf("Read after WritePacket: %v", err)
+	}
+}
+
+// TestWritePacketClearsGSOAfterSegmentation guards against a TSO-aware
+// reader re-segmenting an already-MTU-sized fragment: once SoftwareSegment
+// has actually split a packet, each resulting PacketInfo's GSO must be nil.
+func TestWritePacketClearsGSOAfterSegmentation(t *testing.T) {
+	const ipHdrLen = header.IPv4MinimumSize
+	const tcpHdrLen = header.TCPMinimumSize
+	const mtu = ipHdrLen + tcpHdrLen + 100
+
+	e := New(8, mtu, "")
+	e.SoftwareSegment = true
+
+	pkt := buildTCPv4(t, make([]byte, 350))
+	gso := &stack.GSO{Type: stack.GSOTCPv4, MSS: 100}
+	if err := e.WritePacket(&emptyRoute, gso, 0, pkt); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+
+	n := e.NumQueued()
+	if n < 2 {
+		t.Fatalf("expected WritePacket to have segmented the packet into multiple fragments, queued %d", n)
+	}
+	for i := 0; i < n; i++ {
+		info, err := e.Read()
+		if err != nil {
+			t.Fatalf("Read fragment %d: %v", i, err)
+		}
+		if info.GSO != nil {
+			t.Errorf("fragment %d: PacketInfo.GSO = %v, want nil after segmentation", i, info.GSO)
+		}
+	}
+}
+
+// TestWritePacketKeepsGSOWithoutSegmentation checks the other half of the
+// same invariant: when no split happens (SoftwareSegment off), the original
+// GSO descriptor must still reach the reader so it can segment the packet
+// itself (or hand it to hardware GSO).
+func TestWritePacketKeepsGSOWithoutSegmentation(t *testing.T) {
+	e := New(1, 1500, "")
+	e.SoftwareSegment = false
+
+	pkt := buildTCPv4(t, make([]byte, 350))
+	gso := &stack.GSO{Type: stack.GSOTCPv4, MSS: 100}
+	if err := e.WritePacket(&emptyRoute, gso, 0, pkt); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+
+	info, err := e.Read()
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if info.GSO != gso {
+		t.Fatalf("PacketInfo.GSO = %v, want the original gso (no segmentation happened)", info.GSO)
+	}
+}
+
+func TestReadBatchNoWaitPollsImmediately(t *testing.T) {
+	e := New(4, 1500, "")
+
+	dst := make([]PacketInfo, 4)
+	start := time.Now()
+	n, err := e.ReadBatch(dst, 0)
+	if err != nil {
+		t.Fatalf("ReadBatch: %v", err)
+	}
+	if n != 0 {
+		t.Fatalf("ReadBatch on an empty channel returned n=%d, want 0", n)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatalf("ReadBatch with minWait<=0 took %v on an empty channel; want an immediate, non-blocking poll", elapsed)
+	}
+}
+
+func TestReadBatchDrainsQueued(t *testing.T) {
+	e := New(4, 1500, "")
+	for i := 0; i < 3; i++ {
+		e.ch <- PacketInfo{}
+	}
+
+	dst := make([]PacketInfo, 4)
+	n, err := e.ReadBatch(dst, 0)
+	if err != nil {
+		t.Fatalf("ReadBatch: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("ReadBatch returned n=%d, want 3", n)
+	}
+}
+
+// fakeNetworkDispatcher records every packet delivered via
+// DeliverNetworkPacket, so tests can observe whether InjectLinkAddr actually
+// dispatched a packet.
+type fakeNetworkDispatcher struct {
+	calls  int
+	remote tcpip.LinkAddress
+}
+
+func (f *fakeNetworkDispatcher) DeliverNetworkPacket(linkEP stack.LinkEndpoint, remote, local tcpip.LinkAddress, protocol tcpip.NetworkProtocolNumber, pkt tcpip.PacketBuffer) {
+	f.calls++
+	f.remote = remote
+}
+
+func TestInjectLinkAddrDropsOtherHostUnlessPromiscuous(t *testing.T) {
+	const own tcpip.LinkAddress = "\x00\x11\x22\x33\x44\x55"
+	const other tcpip.LinkAddress = "\x00\x11\x22\x33\x44\x66"
+
+	e := New(1, 1500, own)
+	var dispatcher fakeNetworkDispatcher
+	e.Attach(&dispatcher)
+
+	e.InjectLinkAddr(0, other, tcpip.PacketBuffer{})
+	if dispatcher.calls != 0 {
+		t.Fatalf("non-promiscuous endpoint delivered a packet addressed to another host: calls=%d", dispatcher.calls)
+	}
+
+	e.Promiscuous = true
+	e.InjectLinkAddr(0, other, tcpip.PacketBuffer{})
+	if dispatcher.calls != 1 {
+		t.Fatalf("promiscuous endpoint did not deliver a packet addressed to another host: calls=%d, want 1", dispatcher.calls)
+	}
+	if dispatcher.remote != other {
+		t.Errorf("DeliverNetworkPacket remote = %q, want %q", dispatcher.remote, other)
+	}
+}
+
+func TestWriteFailsWhileLinkDown(t *testing.T) {
+	e := New(1, 1500, "")
+	e.SetLinkUp(false)
+
+	if err := e.WritePacket(&emptyRoute, nil, 0, buildTCPv4(t, nil)); err != tcpip.ErrNoLinkAddress {
+		t.Errorf("WritePacket while link down = %v, want tcpip.ErrNoLinkAddress", err)
+	}
+	if err := e.WritePacketCtx(context.Background(), &emptyRoute, nil, 0, buildTCPv4(t, nil)); err != ErrLinkDown {
+		t.Errorf("WritePacketCtx while link down = %v, want ErrLinkDown", err)
+	}
+	if err := e.WriteRawPacket(buffer.VectorisedView{}); err != tcpip.ErrNoLinkAddress {
+		t.Errorf("WriteRawPacket while link down = %v, want tcpip.ErrNoLinkAddress", err)
+	}
+}
+
+func TestInjectLinkAddrDropsWhileLinkDown(t *testing.T) {
+	e := New(1, 1500, "")
+	var dispatcher fakeNetworkDispatcher
+	e.Attach(&dispatcher)
+	e.SetLinkUp(false)
+
+	e.InjectLinkAddr(0, "", tcpip.PacketBuffer{})
+	if dispatcher.calls != 0 {
+		t.Fatalf("InjectLinkAddr delivered a packet while the link was down: calls=%d", dispatcher.calls)
+	}
+	if got := e.GetStats().LinkDownDrops; got != 1 {
+		t.Errorf("LinkDownDrops = %d, want 1", got)
+	}
+}
+
+// fakeLinkStateDispatcher records every NotifyLinkStateChange call.
+type fakeLinkStateDispatcher struct {
+	calls []bool
+}
+
+func (f *fakeLinkStateDispatcher) NotifyLinkStateChange(up bool) {
+	f.calls = append(f.calls, up)
+}
+
+func TestSetLinkUpNotifiesOnlyOnRealTransitions(t *testing.T) {
+	e := New(1, 1500, "")
+	var handler fakeLinkStateDispatcher
+	e.AttachLinkState(&handler)
+
+	// The endpoint starts up; setting it up again is a no-op and must not
+	// notify.
+	e.SetLinkUp(true)
+	if len(handler.calls) != 0 {
+		t.Fatalf("SetLinkUp(true) on an already-up link notified %d times, want 0", len(handler.calls))
+	}
+
+	e.SetLinkUp(false)
+	e.SetLinkUp(false)
+	e.SetLinkUp(true)
+
+	want := []bool{false, true}
+	if len(handler.calls) != len(want) {
+		t.Fatalf("got %v notifications, want %v", handler.calls, want)
+	}
+	for i, up := range want {
+		if handler.calls[i] != up {
+			t.Errorf("notification %d = %v, want %v", i, handler.calls[i], up)
+		}
+	}
+}
+
+func TestSetLinkAddressAndSetMTU(t *testing.T) {
+	e := New(1, 1500, "\x00\x11\x22\x33\x44\x55")
+
+	const newAddr tcpip.LinkAddress = "\x66\x55\x44\x33\x22\x11"
+	e.SetLinkAddress(newAddr)
+	if got := e.LinkAddress(); got != newAddr {
+		t.Errorf("LinkAddress() = %q, want %q", got, newAddr)
+	}
+
+	e.SetMTU(9000)
+	if got := e.MTU(); got != 9000 {
+		t.Errorf("MTU() = %d, want 9000", got)
+	}
+}
+
+// TestSetLinkUpDuringBlockedWriteDoesNotDeadlock guards against the
+// regression where WritePacket held e.mu.RLock() across a blocking enqueue:
+// with PolicyBlock and a full channel, SetLinkUp would never be able to
+// acquire e.mu.Lock().
+func TestSetLinkUpDuringBlockedWriteDoesNotDeadlock(t *testing.T) {
+	e := New(1, 1500, "")
+	e.SetWritePolicy(PolicyBlock)
+
+	// Fill the channel, then start a write that will block until
+	// something reads from e.ch.
+	e.ch <- PacketInfo{}
+
+	blocked := make(chan struct{})
+	go func() {
+		close(blocked)
+		e.WritePacket(&emptyRoute, nil, 0, buildTCPv4(t, []byte("x")))
+	}()
+	<-blocked
+
+	done := make(chan struct{})
+	go func() {
+		e.SetLinkUp(false)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetLinkUp did not return; a blocked WritePacket is starving it of e.mu")
+	}
+
+	// Unblock the writer so the test doesn't leak a goroutine.
+	<-e.ch
+}
+
+func TestWritePacketCtxCancelUnblocksWriter(t *testing.T) {
+	e := New(1, 1500, "")
+	e.SetWritePolicy(PolicyBlockWithContext)
+	e.ch <- PacketInfo{} // Fill the channel so the next write would block.
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := e.WritePacketCtx(ctx, &emptyRoute, nil, 0, buildTCPv4(t, nil))
+	if err != context.Canceled {
+		t.Fatalf("WritePacketCtx with an already-canceled context = %v, want context.Canceled", err)
+	}
+}
+
+func TestStatsPacketsDroppedOnFullChannel(t *testing.T) {
+	e := New(1, 1500, "")
+	e.ch <- PacketInfo{} // Fill the channel; PolicyDrop is the default.
+
+	if err := e.WritePacket(&emptyRoute, nil, 0, buildTCPv4(t, nil)); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+
+	stats := e.GetStats()
+	if stats.PacketsDropped != 1 {
+		t.Errorf("PacketsDropped = %d, want 1", stats.PacketsDropped)
+	}
+}
+
+func TestStatsPacketsQueuedAndBytesQueued(t *testing.T) {
+	e := New(4, 1500, "")
+
+	payload := []byte("hello, world")
+	if err := e.WritePacket(&emptyRoute, nil, 0, buildTCPv4(t, payload)); err != nil {
+		t.Fatalf("WritePacket: %v", err)
+	}
+
+	stats := e.GetStats()
+	if stats.PacketsQueued != 1 {
+		t.Errorf("PacketsQueued = %d, want 1", stats.PacketsQueued)
+	}
+	if stats.BytesQueued == 0 {
+		t.Errorf("BytesQueued = 0, want a positive count of the queued packet's bytes")
+	}
+}
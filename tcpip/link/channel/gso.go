@@ -0,0 +1,127 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package channel
+
+import (
+	"github.com/polevpn/netstack/tcpip"
+	"github.com/polevpn/netstack/tcpip/buffer"
+	"github.com/polevpn/netstack/tcpip/header"
+	"github.com/polevpn/netstack/tcpip/stack"
+)
+
+// CapabilitySoftwareGSO indicates that the endpoint performs software GSO
+// segmentation itself (see Endpoint.SoftwareSegment) instead of relying on
+// hardware or stack-side segmentation support.
+const CapabilitySoftwareGSO = stack.LinkEndpointCapabilities(1 << 30)
+
+// Segment splits pkt into MTU-sized fragments according to gso, recomputing
+// the IP total length and ID, the TCP sequence number, and the IP/L4
+// checksums for each fragment. It is the software equivalent of hardware
+// TSO/GSO and is reusable by any link endpoint in this module that needs to
+// hand a real consumer MTU-sized frames.
+//
+// Only stack.GSOTCPv4 and stack.GSOTCPv6 are segmented; stack.GSO has no UDP
+// variant to segment against (UDP GSO support would need a payload-only
+// split plus a recomputed UDP length/checksum per fragment, which this
+// package doesn't implement). gso.Type values Segment doesn't recognize —
+// including GSONone and any future addition — fall through unmodified, so
+// callers that enable GSO for a type this function doesn't split must keep
+// their own packets at or under mtu themselves.
+//
+// If gso is nil, or its packet type isn't one Segment knows how to split, a
+// single-element slice containing pkt unmodified is returned.
+func Segment(pkt tcpip.PacketBuffer, gso *stack.GSO, mtu uint32) []tcpip.PacketBuffer {
+	if gso == nil {
+		return []tcpip.PacketBuffer{pkt}
+	}
+
+	switch gso.Type {
+	case stack.GSOTCPv4, stack.GSOTCPv6:
+		return segmentTCP(pkt, gso, mtu)
+	default:
+		return []tcpip.PacketBuffer{pkt}
+	}
+}
+
+// segmentTCP splits a single oversized TCP segment described by pkt/gso into
+// MTU-sized packets, each with its own copy of the IP and TCP headers.
+func segmentTCP(pkt tcpip.PacketBuffer, gso *stack.GSO, mtu uint32) []tcpip.PacketBuffer {
+	full := pkt.Header.View()
+	full = append(full, pkt.Data.ToView()...)
+
+	var ipHdrLen int
+	switch gso.Type {
+	case stack.GSOTCPv4:
+		ipHdrLen = header.IPv4(full).HeaderLength()
+	case stack.GSOTCPv6:
+		ipHdrLen = header.IPv6MinimumSize
+	}
+
+	tcpHdr := header.TCP(full[ipHdrLen:])
+	tcpHdrLen := int(tcpHdr.DataOffset())
+	payload := full[ipHdrLen+tcpHdrLen:]
+
+	segSize := int(mtu) - ipHdrLen - tcpHdrLen
+	if segSize <= 0 || len(payload) <= segSize {
+		return []tcpip.PacketBuffer{pkt}
+	}
+
+	seq := tcpHdr.SequenceNumber()
+	var segments []tcpip.PacketBuffer
+	for off := 0; off < len(payload); off += segSize {
+		end := off + segSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		frame := make([]byte, ipHdrLen+tcpHdrLen+(end-off))
+		copy(frame, full[:ipHdrLen+tcpHdrLen])
+		copy(frame[ipHdrLen+tcpHdrLen:], payload[off:end])
+
+		seg := header.TCP(frame[ipHdrLen:])
+		seg.SetSequenceNumber(seq + uint32(off))
+		// Only the final segment carries PSH/FIN; earlier ones clear them
+		// so the reassembled stream behaves as if it had arrived whole.
+		if end != len(payload) {
+			seg.SetFlags(uint8(tcpHdr.Flags()) &^ (header.TCPFlagFin | header.TCPFlagPsh))
+		}
+
+		switch gso.Type {
+		case stack.GSOTCPv4:
+			ip := header.IPv4(frame)
+			ip.SetTotalLength(uint16(len(frame)))
+			ip.SetID(ip.ID() + uint16(off/segSize))
+			ip.SetChecksum(0)
+			ip.SetChecksum(^ip.CalculateChecksum())
+			seg.SetChecksum(0)
+			seg.SetChecksum(^header.ChecksumCombine(
+				header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(frame)-ipHdrLen)),
+				header.Checksum(frame[ipHdrLen:], 0)))
+		case stack.GSOTCPv6:
+			ip := header.IPv6(frame)
+			ip.SetPayloadLength(uint16(len(frame) - ipHdrLen))
+			seg.SetChecksum(0)
+			seg.SetChecksum(^header.ChecksumCombine(
+				header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(frame)-ipHdrLen)),
+				header.Checksum(frame[ipHdrLen:], 0)))
+		}
+
+		segments = append(segments, tcpip.PacketBuffer{
+			Data: buffer.NewViewFromBytes(frame).ToVectorisedView(),
+		})
+	}
+
+	return segments
+}
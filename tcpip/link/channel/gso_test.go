@@ -0,0 +1,152 @@
+// Copyright 2018 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package channel
+
+import (
+	"testing"
+
+	"github.com/polevpn/netstack/tcpip"
+	"github.com/polevpn/netstack/tcpip/buffer"
+	"github.com/polevpn/netstack/tcpip/header"
+	"github.com/polevpn/netstack/tcpip/stack"
+)
+
+// buildTCPv4 builds a single IPv4/TCP packet carrying payload, with valid IP
+// and TCP checksums, so segmentTCP's recomputed checksums can be checked
+// against header.Checksum rather than against each other.
+func buildTCPv4(t *testing.T, payload []byte) tcpip.PacketBuffer {
+	t.Helper()
+
+	const ipHdrLen = header.IPv4MinimumSize
+	const tcpHdrLen = header.TCPMinimumSize
+
+	buf := make([]byte, ipHdrLen+tcpHdrLen+len(payload))
+	copy(buf[ipHdrLen+tcpHdrLen:], payload)
+
+	tcpHdr := header.TCP(buf[ipHdrLen:])
+	tcpHdr.Encode(&header.TCPFields{
+		SrcPort:    1234,
+		DstPort:    80,
+		SeqNum:     1000,
+		AckNum:     0,
+		DataOffset: tcpHdrLen,
+		Flags:      header.TCPFlagPsh | header.TCPFlagAck,
+		WindowSize: 65535,
+	})
+
+	ip := header.IPv4(buf)
+	ip.Encode(&header.IPv4Fields{
+		IHL:         ipHdrLen,
+		TotalLength: uint16(len(buf)),
+		ID:          42,
+		TTL:         64,
+		Protocol:    uint8(header.TCPProtocolNumber),
+		SrcAddr:     "\x0a\x00\x00\x01",
+		DstAddr:     "\x0a\x00\x00\x02",
+	})
+	ip.SetChecksum(0)
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	tcpHdr.SetChecksum(0)
+	tcpHdr.SetChecksum(^header.ChecksumCombine(
+		header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(buf)-ipHdrLen)),
+		header.Checksum(buf[ipHdrLen:], 0)))
+
+	return tcpip.PacketBuffer{Data: buffer.NewViewFromBytes(buf).ToVectorisedView()}
+}
+
+func TestSegmentTCPv4(t *testing.T) {
+	const ipHdrLen = header.IPv4MinimumSize
+	const tcpHdrLen = header.TCPMinimumSize
+	const mtu = ipHdrLen + tcpHdrLen + 100
+
+	payload := make([]byte, 350)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	pkt := buildTCPv4(t, payload)
+
+	segs := Segment(pkt, &stack.GSO{Type: stack.GSOTCPv4}, mtu)
+	if len(segs) != 4 {
+		t.Fatalf("got %d segments, want 4 (350 bytes over a 100-byte payload budget)", len(segs))
+	}
+
+	wantSeq := uint32(1000)
+	var reassembled []byte
+	for i, seg := range segs {
+		frame := seg.Data.ToView()
+
+		ip := header.IPv4(frame)
+		if got, want := int(ip.TotalLength()), len(frame); got != want {
+			t.Errorf("segment %d: IP total length = %d, want %d (len(frame))", i, got, want)
+		}
+		if !ip.IsChecksumValid() {
+			t.Errorf("segment %d: invalid IP checksum", i)
+		}
+
+		tcpHdr := header.TCP(frame[ipHdrLen:])
+		if got := tcpHdr.SequenceNumber(); got != wantSeq {
+			t.Errorf("segment %d: TCP sequence number = %d, want %d", i, got, wantSeq)
+		}
+
+		// Recompute the checksum over a copy of the segment with its
+		// checksum field zeroed, as the sender does.
+		zeroed := append([]byte(nil), frame[ipHdrLen:]...)
+		header.TCP(zeroed).SetChecksum(0)
+		wantChecksum := ^header.ChecksumCombine(
+			header.PseudoHeaderChecksum(header.TCPProtocolNumber, ip.SourceAddress(), ip.DestinationAddress(), uint16(len(frame)-ipHdrLen)),
+			header.Checksum(zeroed, 0))
+		if got := tcpHdr.Checksum(); got != wantChecksum {
+			t.Errorf("segment %d: TCP checksum = %#x, want %#x", i, got, wantChecksum)
+		}
+
+		segPayload := frame[ipHdrLen+tcpHdrLen:]
+		wantSeq += uint32(len(segPayload))
+		reassembled = append(reassembled, segPayload...)
+
+		wantFlags := uint8(header.TCPFlagPsh | header.TCPFlagAck)
+		if i != len(segs)-1 {
+			wantFlags &^= header.TCPFlagPsh
+		}
+		if got := tcpHdr.Flags(); got != wantFlags {
+			t.Errorf("segment %d: TCP flags = %#x, want %#x", i, got, wantFlags)
+		}
+	}
+
+	if len(reassembled) != len(payload) {
+		t.Fatalf("reassembled payload is %d bytes, want %d", len(reassembled), len(payload))
+	}
+	for i := range payload {
+		if reassembled[i] != payload[i] {
+			t.Fatalf("reassembled payload differs from original at byte %d", i)
+		}
+	}
+}
+
+func TestSegmentUnderMTUPassesThrough(t *testing.T) {
+	pkt := buildTCPv4(t, []byte("short"))
+	segs := Segment(pkt, &stack.GSO{Type: stack.GSOTCPv4}, 1500)
+	if len(segs) != 1 {
+		t.Fatalf("got %d segments for a packet under mtu, want 1", len(segs))
+	}
+}
+
+func TestSegmentUnknownGSOTypePassesThrough(t *testing.T) {
+	pkt := buildTCPv4(t, make([]byte, 350))
+	segs := Segment(pkt, &stack.GSO{Type: stack.GSONone}, 100)
+	if len(segs) != 1 {
+		t.Fatalf("got %d segments for an unsegmentable GSO type, want 1 (unmodified passthrough)", len(segs))
+	}
+}